@@ -4,17 +4,20 @@ import (
 	"fmt"
 	"math"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
 
 	"github.com/grafana/loki/pkg/logql/log"
 	"github.com/grafana/loki/pkg/logqlmodel"
+	"github.com/grafana/loki/pkg/logqlmodel/stats"
 )
 
 // Expr is the root expression which can be a SampleExpr or LogSelectorExpr
@@ -29,11 +32,33 @@ func Clone(e Expr) (Expr, error) {
 	return ParseExpr(e.String())
 }
 
+// PositionRange records the [Start, End) byte offsets of an expression's
+// source text, as produced by the lexer/parser. It powers IDE-style
+// diagnostics (squiggly underlines, precise error locations in Grafana
+// Explore) and lets AST-rewriting tools round-trip positions through
+// Clone/String.
+type PositionRange struct {
+	Start, End int
+}
+
+// PositionRangeFor returns the PositionRange recorded for e, or the zero
+// range if e doesn't carry one.
+func PositionRangeFor(e Expr) PositionRange {
+	if p, ok := e.(interface{ Position() PositionRange }); ok {
+		return p.Position()
+	}
+	return PositionRange{}
+}
+
 // implicit holds default implementations
-type implicit struct{}
+type implicit struct {
+	Pos PositionRange
+}
 
 func (implicit) logQLExpr() {}
 
+func (i implicit) Position() PositionRange { return i.Pos }
+
 // LogSelectorExpr is a LogQL expression filtering and returning logs.
 type LogSelectorExpr interface {
 	Matchers() []*labels.Matcher
@@ -104,8 +129,8 @@ type MatchersExpr struct {
 	implicit
 }
 
-func newMatcherExpr(matchers []*labels.Matcher) *MatchersExpr {
-	return &MatchersExpr{Mts: matchers}
+func newMatcherExpr(pos PositionRange, matchers []*labels.Matcher) *MatchersExpr {
+	return &MatchersExpr{Mts: matchers, implicit: implicit{Pos: pos}}
 }
 
 func (e *MatchersExpr) Matchers() []*labels.Matcher {
@@ -120,6 +145,14 @@ func (e *MatchersExpr) Shardable() bool { return true }
 
 func (e *MatchersExpr) Walk(f WalkFn) { f(e) }
 
+func (e *MatchersExpr) Rewrite(f RewriteFn) Expr {
+	repl, _ := f(e)
+	if repl != nil {
+		return repl
+	}
+	return e
+}
+
 func (e *MatchersExpr) String() string {
 	var sb strings.Builder
 	sb.WriteString("{")
@@ -147,10 +180,11 @@ type PipelineExpr struct {
 	implicit
 }
 
-func newPipelineExpr(left *MatchersExpr, pipeline MultiStageExpr) LogSelectorExpr {
+func newPipelineExpr(pos PositionRange, left *MatchersExpr, pipeline MultiStageExpr) LogSelectorExpr {
 	return &PipelineExpr{
 		Left:        left,
 		MultiStages: pipeline,
+		implicit:    implicit{Pos: pos},
 	}
 }
 
@@ -163,6 +197,32 @@ func (e *PipelineExpr) Shardable() bool {
 	return true
 }
 
+func (e *PipelineExpr) Rewrite(f RewriteFn) Expr {
+	if repl, recurse := f(e); repl != nil {
+		if !recurse {
+			return repl
+		}
+		p, ok := repl.(*PipelineExpr)
+		if !ok {
+			return repl
+		}
+		e = p
+	}
+	if e.Left != nil {
+		if left, ok := e.Left.Rewrite(f).(*MatchersExpr); ok {
+			e.Left = left
+		}
+	}
+	stages := make(MultiStageExpr, 0, len(e.MultiStages))
+	for _, s := range e.MultiStages {
+		if rs, ok := s.Rewrite(f).(StageExpr); ok {
+			stages = append(stages, rs)
+		}
+	}
+	e.MultiStages = stages
+	return e
+}
+
 func (e *PipelineExpr) Walk(f WalkFn) {
 	f(e)
 
@@ -215,11 +275,12 @@ type LineFilterExpr struct {
 	implicit
 }
 
-func newLineFilterExpr(ty labels.MatchType, op, match string) *LineFilterExpr {
+func newLineFilterExpr(pos PositionRange, ty labels.MatchType, op, match string) *LineFilterExpr {
 	return &LineFilterExpr{
-		Ty:    ty,
-		Match: match,
-		Op:    op,
+		Ty:       ty,
+		Match:    match,
+		Op:       op,
+		implicit: implicit{Pos: pos},
 	}
 }
 
@@ -240,12 +301,31 @@ func (e *LineFilterExpr) Walk(f WalkFn) {
 	e.Left.Walk(f)
 }
 
+func (e *LineFilterExpr) Rewrite(f RewriteFn) Expr {
+	if repl, recurse := f(e); repl != nil {
+		if !recurse {
+			return repl
+		}
+		lf, ok := repl.(*LineFilterExpr)
+		if !ok {
+			return repl
+		}
+		e = lf
+	}
+	if e.Left != nil {
+		if left, ok := e.Left.Rewrite(f).(*LineFilterExpr); ok {
+			e.Left = left
+		}
+	}
+	return e
+}
+
 // AddFilterExpr adds a filter expression to a logselector expression.
-func AddFilterExpr(expr LogSelectorExpr, ty labels.MatchType, op, match string) (LogSelectorExpr, error) {
-	filter := newLineFilterExpr(ty, op, match)
+func AddFilterExpr(expr LogSelectorExpr, pos PositionRange, ty labels.MatchType, op, match string) (LogSelectorExpr, error) {
+	filter := newLineFilterExpr(pos, ty, op, match)
 	switch e := expr.(type) {
 	case *MatchersExpr:
-		return newPipelineExpr(e, MultiStageExpr{filter}), nil
+		return newPipelineExpr(PositionRange{Start: e.Position().Start, End: pos.End}, e, MultiStageExpr{filter}), nil
 	case *PipelineExpr:
 		e.MultiStages = append(e.MultiStages, filter)
 		return e, nil
@@ -331,10 +411,11 @@ type LabelParserExpr struct {
 	implicit
 }
 
-func newLabelParserExpr(op, param string) *LabelParserExpr {
+func newLabelParserExpr(pos PositionRange, op, param string) *LabelParserExpr {
 	return &LabelParserExpr{
-		Op:    op,
-		Param: param,
+		Op:       op,
+		Param:    param,
+		implicit: implicit{Pos: pos},
 	}
 }
 
@@ -342,6 +423,14 @@ func (e *LabelParserExpr) Shardable() bool { return true }
 
 func (e *LabelParserExpr) Walk(f WalkFn) { f(e) }
 
+func (e *LabelParserExpr) Rewrite(f RewriteFn) Expr {
+	repl, _ := f(e)
+	if repl != nil {
+		return repl
+	}
+	return e
+}
+
 func (e *LabelParserExpr) Stage() (log.Stage, error) {
 	switch e.Op {
 	case OpParserTypeJSON:
@@ -386,6 +475,14 @@ func (e *LabelFilterExpr) Shardable() bool { return true }
 
 func (e *LabelFilterExpr) Walk(f WalkFn) { f(e) }
 
+func (e *LabelFilterExpr) Rewrite(f RewriteFn) Expr {
+	repl, _ := f(e)
+	if repl != nil {
+		return repl
+	}
+	return e
+}
+
 func (e *LabelFilterExpr) Stage() (log.Stage, error) {
 	switch ip := e.LabelFilterer.(type) {
 	case *log.IPLabelFilter:
@@ -413,6 +510,14 @@ func (e *LineFmtExpr) Shardable() bool { return true }
 
 func (e *LineFmtExpr) Walk(f WalkFn) { f(e) }
 
+func (e *LineFmtExpr) Rewrite(f RewriteFn) Expr {
+	repl, _ := f(e)
+	if repl != nil {
+		return repl
+	}
+	return e
+}
+
 func (e *LineFmtExpr) Stage() (log.Stage, error) {
 	return log.NewFormatter(e.Value)
 }
@@ -437,6 +542,14 @@ func (e *LabelFmtExpr) Shardable() bool { return false }
 
 func (e *LabelFmtExpr) Walk(f WalkFn) { f(e) }
 
+func (e *LabelFmtExpr) Rewrite(f RewriteFn) Expr {
+	repl, _ := f(e)
+	if repl != nil {
+		return repl
+	}
+	return e
+}
+
 func (e *LabelFmtExpr) Stage() (log.Stage, error) {
 	return log.NewLabelsFormatter(e.Formats)
 }
@@ -475,6 +588,14 @@ func (j *JSONExpressionParser) Shardable() bool { return true }
 
 func (j *JSONExpressionParser) Walk(f WalkFn) { f(j) }
 
+func (j *JSONExpressionParser) Rewrite(f RewriteFn) Expr {
+	repl, _ := f(j)
+	if repl != nil {
+		return repl
+	}
+	return j
+}
+
 func (j *JSONExpressionParser) Stage() (log.Stage, error) {
 	return log.NewJSONExpressionParser(j.Expressions)
 }
@@ -494,18 +615,18 @@ func (j *JSONExpressionParser) String() string {
 	return sb.String()
 }
 
-func mustNewMatcher(t labels.MatchType, n, v string) *labels.Matcher {
+func mustNewMatcher(t labels.MatchType, n, v string, pos PositionRange) *labels.Matcher {
 	m, err := labels.NewMatcher(t, n, v)
 	if err != nil {
-		panic(logqlmodel.NewParseError(err.Error(), 0, 0))
+		panic(logqlmodel.NewParseError(err.Error(), pos.Start, pos.End))
 	}
 	return m
 }
 
-func mustNewFloat(s string) float64 {
+func mustNewFloat(s string, pos PositionRange) float64 {
 	n, err := strconv.ParseFloat(s, 64)
 	if err != nil {
-		panic(logqlmodel.NewParseError(fmt.Sprintf("unable to parse float: %s", err.Error()), 0, 0))
+		panic(logqlmodel.NewParseError(fmt.Sprintf("unable to parse float: %s", err.Error()), pos.Start, pos.End))
 	}
 	return n
 }
@@ -543,6 +664,7 @@ type LogRange struct {
 	Left     LogSelectorExpr
 	Interval time.Duration
 	Offset   time.Duration
+	At       *AtModifier
 
 	Unwrap *UnwrapExpr
 
@@ -561,6 +683,9 @@ func (r LogRange) String() string {
 		offsetExpr := OffsetExpr{Offset: r.Offset}
 		sb.WriteString(offsetExpr.String())
 	}
+	if r.At != nil {
+		sb.WriteString(r.At.String())
+	}
 	return sb.String()
 }
 
@@ -574,7 +699,26 @@ func (r *LogRange) Walk(f WalkFn) {
 	r.Left.Walk(f)
 }
 
-func newLogRange(left LogSelectorExpr, interval time.Duration, u *UnwrapExpr, o *OffsetExpr) *LogRange {
+func (r *LogRange) Rewrite(f RewriteFn) Expr {
+	if repl, recurse := f(r); repl != nil {
+		if !recurse {
+			return repl
+		}
+		lr, ok := repl.(*LogRange)
+		if !ok {
+			return repl
+		}
+		r = lr
+	}
+	if r.Left != nil {
+		if left, ok := r.Left.Rewrite(f).(LogSelectorExpr); ok {
+			r.Left = left
+		}
+	}
+	return r
+}
+
+func newLogRange(left LogSelectorExpr, interval time.Duration, u *UnwrapExpr, o *OffsetExpr, a *AtModifier) *LogRange {
 	var offset time.Duration
 	if o != nil {
 		offset = o.Offset
@@ -584,6 +728,45 @@ func newLogRange(left LogSelectorExpr, interval time.Duration, u *UnwrapExpr, o
 		Interval: interval,
 		Unwrap:   u,
 		Offset:   offset,
+		At:       a,
+	}
+}
+
+// AtModifierPreset identifies one of the special `@ start()` / `@ end()` forms
+// of the `@` modifier, as opposed to a fixed timestamp.
+type AtModifierPreset int
+
+const (
+	AtModifierNone AtModifierPreset = iota
+	AtModifierStart
+	AtModifierEnd
+)
+
+// AtModifier represents PromQL's `@ <timestamp>` modifier on a log range or
+// instant selector, pinning the evaluation timestamp for that leg of the AST
+// independently of the outer query time, e.g. `rate({app="foo"}[5m] @ 1609746000)`
+// or `rate({app="foo"}[5m] @ start())`.
+type AtModifier struct {
+	Time   time.Time
+	Preset AtModifierPreset
+}
+
+func newAtModifier(t time.Time) *AtModifier {
+	return &AtModifier{Time: t}
+}
+
+func newAtModifierPreset(preset AtModifierPreset) *AtModifier {
+	return &AtModifier{Preset: preset}
+}
+
+func (a *AtModifier) String() string {
+	switch a.Preset {
+	case AtModifierStart:
+		return fmt.Sprintf(" %s start()", OpAt)
+	case AtModifierEnd:
+		return fmt.Sprintf(" %s end()", OpAt)
+	default:
+		return fmt.Sprintf(" %s %d", OpAt, a.Time.Unix())
 	}
 }
 
@@ -632,6 +815,21 @@ const (
 	OpRangeTypeLast        = "last_over_time"
 	OpRangeTypeAbsent      = "absent_over_time"
 
+	// native histogram range vector ops
+	OpRangeTypeHistogram = "histogram_over_time"
+
+	// native histogram vector ops
+	//
+	// histogram_quantile/histogram_count/histogram_sum/histogram_fraction
+	// are PromQL vector functions over an instant vector of histogram
+	// samples (typically the output of histogram_over_time), not range
+	// aggregations over a raw range selector, so they're hosted on
+	// HistogramVectorExpr rather than RangeAggregationExpr.
+	OpTypeHistogramQuantile = "histogram_quantile"
+	OpTypeHistogramCount    = "histogram_count"
+	OpTypeHistogramSum      = "histogram_sum"
+	OpTypeHistogramFraction = "histogram_fraction"
+
 	// binops - logical/set
 	OpTypeOr     = "or"
 	OpTypeAnd    = "and"
@@ -666,6 +864,7 @@ const (
 	OpPipe   = "|"
 	OpUnwrap = "unwrap"
 	OpOffset = "offset"
+	OpAt     = "@"
 
 	OpOn       = "on"
 	OpIgnoring = "ignoring"
@@ -679,6 +878,7 @@ const (
 	OpConvDurationSeconds = "duration_seconds"
 
 	OpLabelReplace = "label_replace"
+	OpLabelJoin    = "label_join"
 
 	// function filters
 	OpFilterIP = "ip"
@@ -709,34 +909,166 @@ type SampleExpr interface {
 	Selector() LogSelectorExpr
 	Extractor() (SampleExtractor, error)
 	MatcherGroups() []MatcherRange
+	// HasHistogram reports whether this expression can produce native
+	// histogram samples. ConstantFoldOptimizer consults it to skip folding,
+	// and mustNewHistogramVectorExpr to require a histogram-valued operand;
+	// MergeBinOp does not, it checks each sample's Point.H directly.
+	HasHistogram() bool
 	Expr
 }
 
+// RangeExpr is the range-vector operand consumed by a RangeAggregationExpr:
+// either a LogRange (`selector[5m]`) or a SubqueryExpr (`sample_expr[1h:5m]`).
+// This lets numeric range aggregations such as max_over_time nest a
+// SubqueryExpr the same way they consume a plain log selector range.
+type RangeExpr interface {
+	Expr
+	Selector() LogSelectorExpr
+	GetUnwrap() *UnwrapExpr
+	GetInterval() time.Duration
+	GetOffset() time.Duration
+	GetAt() *AtModifier
+}
+
+func (r *LogRange) Selector() LogSelectorExpr { return r.Left }
+
+func (r *LogRange) GetUnwrap() *UnwrapExpr { return r.Unwrap }
+
+func (r *LogRange) GetInterval() time.Duration { return r.Interval }
+
+func (r *LogRange) GetOffset() time.Duration { return r.Offset }
+
+func (r *LogRange) GetAt() *AtModifier { return r.At }
+
+// SubqueryExpr wraps a SampleExpr with its own range and step, letting range
+// aggregations nest arbitrarily, e.g.
+// max_over_time(rate({job="api"} |= "err" [1m])[1h:5m]).
+type SubqueryExpr struct {
+	Left     SampleExpr
+	Interval time.Duration
+	Step     time.Duration
+	Offset   time.Duration
+	At       *AtModifier
+
+	implicit
+}
+
+func newSubqueryExpr(left SampleExpr, interval, step, offset time.Duration, at *AtModifier) *SubqueryExpr {
+	return &SubqueryExpr{
+		Left:     left,
+		Interval: interval,
+		Step:     step,
+		Offset:   offset,
+		At:       at,
+	}
+}
+
+func (s *SubqueryExpr) Selector() LogSelectorExpr { return s.Left.Selector() }
+
+func (s *SubqueryExpr) GetUnwrap() *UnwrapExpr { return nil }
+
+func (s *SubqueryExpr) GetInterval() time.Duration { return s.Interval }
+
+func (s *SubqueryExpr) GetOffset() time.Duration { return s.Offset }
+
+func (s *SubqueryExpr) GetAt() *AtModifier { return s.At }
+
+func (s *SubqueryExpr) Extractor() (log.SampleExtractor, error) { return s.Left.Extractor() }
+
+func (s *SubqueryExpr) HasHistogram() bool { return s.Left.HasHistogram() }
+
+func (s *SubqueryExpr) MatcherGroups() []MatcherRange { return s.Left.MatcherGroups() }
+
+func (s *SubqueryExpr) Shardable() bool { return s.Left.Shardable() }
+
+func (s *SubqueryExpr) Walk(f WalkFn) {
+	f(s)
+	if s.Left == nil {
+		return
+	}
+	s.Left.Walk(f)
+}
+
+func (s *SubqueryExpr) Rewrite(f RewriteFn) Expr {
+	if repl, recurse := f(s); repl != nil {
+		if !recurse {
+			return repl
+		}
+		sq, ok := repl.(*SubqueryExpr)
+		if !ok {
+			return repl
+		}
+		s = sq
+	}
+	if s.Left != nil {
+		if left, ok := s.Left.Rewrite(f).(SampleExpr); ok {
+			s.Left = left
+		}
+	}
+	return s
+}
+
+// impls Stringer
+func (s *SubqueryExpr) String() string {
+	var sb strings.Builder
+	sb.WriteString(s.Left.String())
+	sb.WriteString("[")
+	sb.WriteString(model.Duration(s.Interval).String())
+	sb.WriteString(":")
+	if s.Step != 0 {
+		sb.WriteString(model.Duration(s.Step).String())
+	}
+	sb.WriteString("]")
+	if s.Offset != 0 {
+		offsetExpr := OffsetExpr{Offset: s.Offset}
+		sb.WriteString(offsetExpr.String())
+	}
+	if s.At != nil {
+		sb.WriteString(s.At.String())
+	}
+	return sb.String()
+}
+
+// HistogramParams carries the optional schema configuration for
+// histogram_over_time, controlling the resolution (bucket factor) of the
+// resulting native (sparse) histogram. Schema follows the same convention as
+// github.com/prometheus/prometheus/model/histogram: higher means finer
+// buckets.
+type HistogramParams struct {
+	Schema int
+}
+
+func newHistogramParams(schema int) *HistogramParams {
+	return &HistogramParams{Schema: schema}
+}
+
 type RangeAggregationExpr struct {
-	Left      *LogRange
+	Left      RangeExpr
 	Operation string
 
-	Params   *float64
-	Grouping *Grouping
+	Params    *float64
+	Grouping  *Grouping
+	Histogram *HistogramParams
 	implicit
 }
 
-func newRangeAggregationExpr(left *LogRange, operation string, gr *Grouping, stringParams *string) SampleExpr {
+func newRangeAggregationExpr(left RangeExpr, operation string, gr *Grouping, stringParams *string) SampleExpr {
+	pos := PositionRangeFor(left)
 	var params *float64
 	if stringParams != nil {
 		if operation != OpRangeTypeQuantile {
-			panic(logqlmodel.NewParseError(fmt.Sprintf("parameter %s not supported for operation %s", *stringParams, operation), 0, 0))
+			panic(logqlmodel.NewParseError(fmt.Sprintf("parameter %s not supported for operation %s", *stringParams, operation), pos.Start, pos.End))
 		}
 		var err error
 		params = new(float64)
 		*params, err = strconv.ParseFloat(*stringParams, 64)
 		if err != nil {
-			panic(logqlmodel.NewParseError(fmt.Sprintf("invalid parameter for operation %s: %s", operation, err), 0, 0))
+			panic(logqlmodel.NewParseError(fmt.Sprintf("invalid parameter for operation %s: %s", operation, err), pos.Start, pos.End))
 		}
 
 	} else {
 		if operation == OpRangeTypeQuantile {
-			panic(logqlmodel.NewParseError(fmt.Sprintf("parameter required for operation %s", operation), 0, 0))
+			panic(logqlmodel.NewParseError(fmt.Sprintf("parameter required for operation %s", operation), pos.Start, pos.End))
 		}
 	}
 	e := &RangeAggregationExpr{
@@ -744,25 +1076,54 @@ func newRangeAggregationExpr(left *LogRange, operation string, gr *Grouping, str
 		Operation: operation,
 		Grouping:  gr,
 		Params:    params,
+		implicit:  implicit{Pos: pos},
 	}
 	if err := e.validate(); err != nil {
-		panic(logqlmodel.NewParseError(err.Error(), 0, 0))
+		panic(logqlmodel.NewParseError(err.Error(), pos.Start, pos.End))
+	}
+	return e
+}
+
+// newHistogramRangeAggregationExpr builds a histogram_over_time aggregation,
+// optionally configured with a `schema=<n>` parameter controlling the
+// resolution of the resulting native histogram, e.g.
+// histogram_over_time({job="api"} | unwrap duration_seconds [5m] schema=8).
+func newHistogramRangeAggregationExpr(left RangeExpr, gr *Grouping, schema *string) SampleExpr {
+	pos := PositionRangeFor(left)
+	var hp *HistogramParams
+	if schema != nil {
+		n, err := strconv.Atoi(*schema)
+		if err != nil {
+			panic(logqlmodel.NewParseError(fmt.Sprintf("invalid schema for operation %s: %s", OpRangeTypeHistogram, err), pos.Start, pos.End))
+		}
+		hp = newHistogramParams(n)
+	}
+	e := &RangeAggregationExpr{
+		Left:      left,
+		Operation: OpRangeTypeHistogram,
+		Grouping:  gr,
+		Histogram: hp,
+		implicit:  implicit{Pos: pos},
+	}
+	if err := e.validate(); err != nil {
+		panic(logqlmodel.NewParseError(err.Error(), pos.Start, pos.End))
 	}
 	return e
 }
 
 func (e *RangeAggregationExpr) Selector() LogSelectorExpr {
-	return e.Left.Left
+	return e.Left.Selector()
 }
 
 func (e *RangeAggregationExpr) MatcherGroups() []MatcherRange {
-	xs := e.Left.Left.Matchers()
+	xs := e.Left.Selector().Matchers()
 	if len(xs) > 0 {
 		return []MatcherRange{
 			{
 				Matchers: xs,
-				Interval: e.Left.Interval,
-				Offset:   e.Left.Offset,
+				Interval: e.Left.GetInterval(),
+				Offset:   e.Left.GetOffset(),
+				At:       e.Left.GetAt(),
 			},
 		}
 	}
@@ -772,16 +1133,25 @@ func (e *RangeAggregationExpr) MatcherGroups() []MatcherRange {
 func (e RangeAggregationExpr) validate() error {
 	if e.Grouping != nil {
 		switch e.Operation {
-		case OpRangeTypeAvg, OpRangeTypeStddev, OpRangeTypeStdvar, OpRangeTypeQuantile, OpRangeTypeMax, OpRangeTypeMin, OpRangeTypeFirst, OpRangeTypeLast:
+		case OpRangeTypeAvg, OpRangeTypeSum, OpRangeTypeStddev, OpRangeTypeStdvar, OpRangeTypeQuantile, OpRangeTypeMax, OpRangeTypeMin, OpRangeTypeFirst, OpRangeTypeLast:
 		default:
 			return fmt.Errorf("grouping not allowed for %s aggregation", e.Operation)
 		}
 	}
-	if e.Left.Unwrap != nil {
+	if _, ok := e.Left.(*SubqueryExpr); ok {
+		switch e.Operation {
+		case OpRangeTypeAvg, OpRangeTypeSum, OpRangeTypeMax, OpRangeTypeMin, OpRangeTypeStddev,
+			OpRangeTypeStdvar, OpRangeTypeQuantile, OpRangeTypeFirst, OpRangeTypeLast:
+			return nil
+		default:
+			return fmt.Errorf("invalid aggregation %s over a subquery", e.Operation)
+		}
+	}
+	if e.Left.GetUnwrap() != nil {
 		switch e.Operation {
 		case OpRangeTypeAvg, OpRangeTypeSum, OpRangeTypeMax, OpRangeTypeMin, OpRangeTypeStddev,
 			OpRangeTypeStdvar, OpRangeTypeQuantile, OpRangeTypeRate, OpRangeTypeRateCounter,
-			OpRangeTypeAbsent, OpRangeTypeFirst, OpRangeTypeLast:
+			OpRangeTypeAbsent, OpRangeTypeFirst, OpRangeTypeLast, OpRangeTypeHistogram:
 			return nil
 		default:
 			return fmt.Errorf("invalid aggregation %s with unwrap", e.Operation)
@@ -809,6 +1179,9 @@ func (e *RangeAggregationExpr) String() string {
 		sb.WriteString(",")
 	}
 	sb.WriteString(e.Left.String())
+	if e.Histogram != nil {
+		sb.WriteString(fmt.Sprintf(" schema=%d", e.Histogram.Schema))
+	}
 	sb.WriteString(")")
 	if e.Grouping != nil {
 		sb.WriteString(e.Grouping.String())
@@ -829,6 +1202,25 @@ func (e *RangeAggregationExpr) Walk(f WalkFn) {
 	e.Left.Walk(f)
 }
 
+func (e *RangeAggregationExpr) Rewrite(f RewriteFn) Expr {
+	if repl, recurse := f(e); repl != nil {
+		if !recurse {
+			return repl
+		}
+		r, ok := repl.(*RangeAggregationExpr)
+		if !ok {
+			return repl
+		}
+		e = r
+	}
+	if e.Left != nil {
+		if left, ok := e.Left.Rewrite(f).(RangeExpr); ok {
+			e.Left = left
+		}
+	}
+	return e
+}
+
 type Grouping struct {
 	Groups  []string
 	Without bool
@@ -893,6 +1285,10 @@ func (e *VectorAggregationExpr) MatcherGroups() []MatcherRange {
 	return e.Left.MatcherGroups()
 }
 
+func (e *VectorAggregationExpr) HasHistogram() bool {
+	return e.Left.HasHistogram()
+}
+
 func (e *VectorAggregationExpr) Selector() LogSelectorExpr {
 	return e.Left.Selector()
 }
@@ -964,6 +1360,25 @@ func (e *VectorAggregationExpr) Walk(f WalkFn) {
 	e.Left.Walk(f)
 }
 
+func (e *VectorAggregationExpr) Rewrite(f RewriteFn) Expr {
+	if repl, recurse := f(e); repl != nil {
+		if !recurse {
+			return repl
+		}
+		v, ok := repl.(*VectorAggregationExpr)
+		if !ok {
+			return repl
+		}
+		e = v
+	}
+	if e.Left != nil {
+		if left, ok := e.Left.Rewrite(f).(SampleExpr); ok {
+			e.Left = left
+		}
+	}
+	return e
+}
+
 // VectorMatchCardinality describes the cardinality relationship
 // of two Vectors in a binary operation.
 type VectorMatchCardinality int
@@ -1012,12 +1427,26 @@ type BinOpExpr struct {
 	RHS  SampleExpr
 	Op   string
 	Opts *BinOpOptions
+	Pos  PositionRange
 }
 
+func (e *BinOpExpr) Position() PositionRange { return e.Pos }
+
 func (e *BinOpExpr) MatcherGroups() []MatcherRange {
 	return append(e.SampleExpr.MatcherGroups(), e.RHS.MatcherGroups()...)
 }
 
+// Children returns e's two legs, so CountQuerySamples (and, eventually,
+// the step evaluator) can attribute a child shared by both legs only once
+// per step, not once per leg.
+func (e *BinOpExpr) Children() []SampleExpr {
+	return []SampleExpr{e.SampleExpr, e.RHS}
+}
+
+func (e *BinOpExpr) HasHistogram() bool {
+	return e.SampleExpr.HasHistogram() || e.RHS.HasHistogram()
+}
+
 func (e *BinOpExpr) String() string {
 	op := e.Op
 	if e.Opts != nil {
@@ -1050,9 +1479,22 @@ func (e *BinOpExpr) String() string {
 // impl SampleExpr
 func (e *BinOpExpr) Shardable() bool {
 	if e.Opts != nil && e.Opts.VectorMatching != nil {
-		// prohibit sharding when we're changing the label groupings, such as on or ignoring
+		// prohibit sharding when we're changing the label groupings, such as
+		// on or ignoring. This applies just as much to and/or below: an
+		// explicit on()/ignoring() clause changes which labels decide set
+		// membership, and a shard only ever sees a subset of series, so it
+		// can't be trusted to decide membership under a matching clause on
+		// its own.
 		return false
 	}
+	if IsLogicalBinOp(e.Op) {
+		// or/and distribute over shard concatenation because set membership
+		// is decided purely by each series' vector-matching labels, which
+		// sharding never mutates. unless is excluded: it's not symmetric,
+		// so a shard missing the full RHS can wrongly keep a series that
+		// would've been excluded against the complete set.
+		return shardableOps[e.Op] && e.SampleExpr.Shardable() && e.RHS.Shardable()
+	}
 	return shardableOps[e.Op] && e.SampleExpr.Shardable() && e.RHS.Shardable()
 }
 
@@ -1060,14 +1502,36 @@ func (e *BinOpExpr) Walk(f WalkFn) {
 	walkAll(f, e.SampleExpr, e.RHS)
 }
 
+func (e *BinOpExpr) Rewrite(f RewriteFn) Expr {
+	if repl, recurse := f(e); repl != nil {
+		if !recurse {
+			return repl
+		}
+		b, ok := repl.(*BinOpExpr)
+		if !ok {
+			return repl
+		}
+		e = b
+	}
+	if left, ok := e.SampleExpr.Rewrite(f).(SampleExpr); ok {
+		e.SampleExpr = left
+	}
+	if right, ok := e.RHS.Rewrite(f).(SampleExpr); ok {
+		e.RHS = right
+	}
+	return e
+}
+
 func mustNewBinOpExpr(op string, opts *BinOpOptions, lhs, rhs Expr) SampleExpr {
+	pos := PositionRange{Start: PositionRangeFor(lhs).Start, End: PositionRangeFor(rhs).End}
+
 	left, ok := lhs.(SampleExpr)
 	if !ok {
 		panic(logqlmodel.NewParseError(fmt.Sprintf(
 			"unexpected type for left leg of binary operation (%s): %T",
 			op,
 			lhs,
-		), 0, 0))
+		), pos.Start, pos.End))
 	}
 
 	right, ok := rhs.(SampleExpr)
@@ -1076,7 +1540,7 @@ func mustNewBinOpExpr(op string, opts *BinOpOptions, lhs, rhs Expr) SampleExpr {
 			"unexpected type for right leg of binary operation (%s): %T",
 			op,
 			rhs,
-		), 0, 0))
+		), pos.Start, pos.End))
 	}
 
 	leftLit, lOk := left.(*LiteralExpr)
@@ -1088,7 +1552,7 @@ func mustNewBinOpExpr(op string, opts *BinOpOptions, lhs, rhs Expr) SampleExpr {
 				"unexpected literal for left leg of logical/set binary operation (%s): %f",
 				op,
 				leftLit.Val,
-			), 0, 0))
+			), pos.Start, pos.End))
 		}
 
 		if rOk {
@@ -1096,7 +1560,7 @@ func mustNewBinOpExpr(op string, opts *BinOpOptions, lhs, rhs Expr) SampleExpr {
 				"unexpected literal for right leg of logical/set binary operation (%s): %f",
 				op,
 				rightLit.Val,
-			), 0, 0))
+			), pos.Start, pos.End))
 		}
 	}
 
@@ -1110,6 +1574,7 @@ func mustNewBinOpExpr(op string, opts *BinOpOptions, lhs, rhs Expr) SampleExpr {
 		RHS:        right,
 		Op:         op,
 		Opts:       opts,
+		Pos:        pos,
 	}
 }
 
@@ -1127,6 +1592,64 @@ func reduceBinOp(op string, left, right *LiteralExpr) *LiteralExpr {
 	return &LiteralExpr{Val: merged.V}
 }
 
+// newHistogramSample builds the promql.Sample carrying a native histogram
+// result, at the same timestamp as the leg the arithmetic was anchored to.
+func newHistogramSample(metric labels.Labels, t int64, h *histogram.FloatHistogram) *promql.Sample {
+	return &promql.Sample{Metric: metric, Point: promql.Point{T: t, H: h}}
+}
+
+// mergeHistogramBinOp applies op to left/right when at least one side
+// carries a native histogram (promql.Sample.Point.H), mirroring upstream
+// promql: +/- add/subtract the two histograms, */÷ by a plain float scales
+// every bucket, and anything else mixing a histogram with an incompatible
+// operand returns nil, dropping the sample rather than erroring the query
+// (mirroring Prometheus' HistogramInfo warning).
+func mergeHistogramBinOp(op string, left, right *promql.Sample) *promql.Sample {
+	switch op {
+	case OpTypeAdd:
+		if left.Point.H == nil || right.Point.H == nil {
+			return nil
+		}
+		h, err := left.Point.H.Copy().Add(right.Point.H)
+		if err != nil {
+			return nil
+		}
+		return newHistogramSample(left.Metric, left.Point.T, h)
+
+	case OpTypeSub:
+		if left.Point.H == nil || right.Point.H == nil {
+			return nil
+		}
+		h, err := left.Point.H.Copy().Sub(right.Point.H)
+		if err != nil {
+			return nil
+		}
+		return newHistogramSample(left.Metric, left.Point.T, h)
+
+	case OpTypeMul:
+		switch {
+		case left.Point.H != nil && right.Point.H == nil:
+			return newHistogramSample(left.Metric, left.Point.T, left.Point.H.Copy().Mul(right.Point.V))
+		case right.Point.H != nil && left.Point.H == nil:
+			return newHistogramSample(left.Metric, left.Point.T, right.Point.H.Copy().Mul(left.Point.V))
+		default:
+			return nil
+		}
+
+	case OpTypeDiv:
+		if left.Point.H != nil && right.Point.H == nil {
+			if right.Point.V == 0 {
+				return nil
+			}
+			return newHistogramSample(left.Metric, left.Point.T, left.Point.H.Copy().Div(right.Point.V))
+		}
+		return nil
+
+	default:
+		return nil
+	}
+}
+
 func MergeBinOp(op string, left, right *promql.Sample, filter, isVectorComparison bool) *promql.Sample {
 	var merger func(left, right *promql.Sample) *promql.Sample
 
@@ -1136,6 +1659,9 @@ func MergeBinOp(op string, left, right *promql.Sample, filter, isVectorCompariso
 			if left == nil || right == nil {
 				return nil
 			}
+			if left.Point.H != nil || right.Point.H != nil {
+				return mergeHistogramBinOp(op, left, right)
+			}
 			res := promql.Sample{
 				Metric: left.Metric,
 				Point:  left.Point,
@@ -1149,6 +1675,9 @@ func MergeBinOp(op string, left, right *promql.Sample, filter, isVectorCompariso
 			if left == nil || right == nil {
 				return nil
 			}
+			if left.Point.H != nil || right.Point.H != nil {
+				return mergeHistogramBinOp(op, left, right)
+			}
 			res := promql.Sample{
 				Metric: left.Metric,
 				Point:  left.Point,
@@ -1162,6 +1691,9 @@ func MergeBinOp(op string, left, right *promql.Sample, filter, isVectorCompariso
 			if left == nil || right == nil {
 				return nil
 			}
+			if left.Point.H != nil || right.Point.H != nil {
+				return mergeHistogramBinOp(op, left, right)
+			}
 			res := promql.Sample{
 				Metric: left.Metric,
 				Point:  left.Point,
@@ -1175,6 +1707,9 @@ func MergeBinOp(op string, left, right *promql.Sample, filter, isVectorCompariso
 			if left == nil || right == nil {
 				return nil
 			}
+			if left.Point.H != nil || right.Point.H != nil {
+				return mergeHistogramBinOp(op, left, right)
+			}
 			res := promql.Sample{
 				Metric: left.Metric,
 				Point:  left.Point,
@@ -1226,6 +1761,11 @@ func MergeBinOp(op string, left, right *promql.Sample, filter, isVectorCompariso
 			if left == nil || right == nil {
 				return nil
 			}
+			if left.Point.H != nil || right.Point.H != nil {
+				// comparisons aren't defined over native histograms; drop the
+				// sample, mirroring Prometheus' behavior on a HistogramInfo warning.
+				return nil
+			}
 
 			res := &promql.Sample{
 				Metric: left.Metric,
@@ -1247,6 +1787,11 @@ func MergeBinOp(op string, left, right *promql.Sample, filter, isVectorCompariso
 			if left == nil || right == nil {
 				return nil
 			}
+			if left.Point.H != nil || right.Point.H != nil {
+				// comparisons aren't defined over native histograms; drop the
+				// sample, mirroring Prometheus' behavior on a HistogramInfo warning.
+				return nil
+			}
 
 			res := &promql.Sample{
 				Metric: left.Metric,
@@ -1268,6 +1813,11 @@ func MergeBinOp(op string, left, right *promql.Sample, filter, isVectorCompariso
 			if left == nil || right == nil {
 				return nil
 			}
+			if left.Point.H != nil || right.Point.H != nil {
+				// comparisons aren't defined over native histograms; drop the
+				// sample, mirroring Prometheus' behavior on a HistogramInfo warning.
+				return nil
+			}
 
 			res := &promql.Sample{
 				Metric: left.Metric,
@@ -1289,6 +1839,11 @@ func MergeBinOp(op string, left, right *promql.Sample, filter, isVectorCompariso
 			if left == nil || right == nil {
 				return nil
 			}
+			if left.Point.H != nil || right.Point.H != nil {
+				// comparisons aren't defined over native histograms; drop the
+				// sample, mirroring Prometheus' behavior on a HistogramInfo warning.
+				return nil
+			}
 
 			res := &promql.Sample{
 				Metric: left.Metric,
@@ -1310,6 +1865,11 @@ func MergeBinOp(op string, left, right *promql.Sample, filter, isVectorCompariso
 			if left == nil || right == nil {
 				return nil
 			}
+			if left.Point.H != nil || right.Point.H != nil {
+				// comparisons aren't defined over native histograms; drop the
+				// sample, mirroring Prometheus' behavior on a HistogramInfo warning.
+				return nil
+			}
 
 			res := &promql.Sample{
 				Metric: left.Metric,
@@ -1331,6 +1891,11 @@ func MergeBinOp(op string, left, right *promql.Sample, filter, isVectorCompariso
 			if left == nil || right == nil {
 				return nil
 			}
+			if left.Point.H != nil || right.Point.H != nil {
+				// comparisons aren't defined over native histograms; drop the
+				// sample, mirroring Prometheus' behavior on a HistogramInfo warning.
+				return nil
+			}
 
 			res := &promql.Sample{
 				Metric: left.Metric,
@@ -1367,6 +1932,83 @@ func MergeBinOp(op string, left, right *promql.Sample, filter, isVectorCompariso
 	return res
 }
 
+// vectorMatchingSignature returns a string key identifying lbls' equality
+// class under vector matching: labels named in `names` are kept when `on`
+// is true and dropped when `on` is false (i.e. `names` is an ignoring list).
+func vectorMatchingSignature(lbls labels.Labels, on bool, names []string) string {
+	include := make(map[string]struct{}, len(names))
+	for _, n := range names {
+		include[n] = struct{}{}
+	}
+	var sb strings.Builder
+	for _, l := range lbls {
+		_, named := include[l.Name]
+		if named == on {
+			sb.WriteString(l.Name)
+			sb.WriteByte('=')
+			sb.WriteString(l.Value)
+			sb.WriteByte(',')
+		}
+	}
+	return sb.String()
+}
+
+// MergeSetBinOp implements the "and", "or", "unless" set binary operators
+// for a single evaluation step. Unlike MergeBinOp, which merges one paired
+// sample at a time, a set operator decides membership across the whole
+// step vector, so it's keyed by the signature of each series' vector
+// matching labels (on(...)/ignoring(...)) rather than by pairing samples
+// one-to-one.
+func MergeSetBinOp(op string, lhs, rhs []promql.Sample, vm *VectorMatching) []promql.Sample {
+	on, names := false, []string(nil)
+	if vm != nil {
+		on = vm.On
+		names = vm.MatchingLabels
+	}
+
+	rhsSigs := make(map[string]struct{}, len(rhs))
+	for _, s := range rhs {
+		rhsSigs[vectorMatchingSignature(s.Metric, on, names)] = struct{}{}
+	}
+
+	switch op {
+	case OpTypeAnd:
+		out := make([]promql.Sample, 0, len(lhs))
+		for _, s := range lhs {
+			if _, ok := rhsSigs[vectorMatchingSignature(s.Metric, on, names)]; ok {
+				out = append(out, s)
+			}
+		}
+		return out
+
+	case OpTypeUnless:
+		out := make([]promql.Sample, 0, len(lhs))
+		for _, s := range lhs {
+			if _, ok := rhsSigs[vectorMatchingSignature(s.Metric, on, names)]; !ok {
+				out = append(out, s)
+			}
+		}
+		return out
+
+	case OpTypeOr:
+		lhsSigs := make(map[string]struct{}, len(lhs))
+		out := make([]promql.Sample, 0, len(lhs)+len(rhs))
+		for _, s := range lhs {
+			lhsSigs[vectorMatchingSignature(s.Metric, on, names)] = struct{}{}
+			out = append(out, s)
+		}
+		for _, s := range rhs {
+			if _, ok := lhsSigs[vectorMatchingSignature(s.Metric, on, names)]; !ok {
+				out = append(out, s)
+			}
+		}
+		return out
+
+	default:
+		panic(errors.Errorf("should never happen: unexpected set operation: (%s)", op))
+	}
+}
+
 type LiteralExpr struct {
 	Val float64
 	implicit
@@ -1403,6 +2045,14 @@ func (e *LiteralExpr) Matchers() []*labels.Matcher             { return nil }
 func (e *LiteralExpr) MatcherGroups() []MatcherRange           { return nil }
 func (e *LiteralExpr) Extractor() (log.SampleExtractor, error) { return nil, nil }
 func (e *LiteralExpr) Value() float64                          { return e.Val }
+func (e *LiteralExpr) HasHistogram() bool                      { return false }
+
+func (e *LiteralExpr) Rewrite(f RewriteFn) Expr {
+	if repl, _ := f(e); repl != nil {
+		return repl
+	}
+	return e
+}
 
 // helper used to impl Stringer for vector and range aggregations
 // nolint:interfacer
@@ -1459,6 +2109,17 @@ func (e *LabelReplaceExpr) MatcherGroups() []MatcherRange {
 	return e.Left.MatcherGroups()
 }
 
+// Children returns e's sole operand: label_replace doesn't consume
+// samples beyond what Left already does, so CountQuerySamples should
+// attribute cost to Left's leaves, not to this node.
+func (e *LabelReplaceExpr) Children() []SampleExpr {
+	return []SampleExpr{e.Left}
+}
+
+func (e *LabelReplaceExpr) HasHistogram() bool {
+	return e.Left.HasHistogram()
+}
+
 func (e *LabelReplaceExpr) Extractor() (SampleExtractor, error) {
 	return e.Left.Extractor()
 }
@@ -1475,6 +2136,25 @@ func (e *LabelReplaceExpr) Walk(f WalkFn) {
 	e.Left.Walk(f)
 }
 
+func (e *LabelReplaceExpr) Rewrite(f RewriteFn) Expr {
+	if repl, recurse := f(e); repl != nil {
+		if !recurse {
+			return repl
+		}
+		lr, ok := repl.(*LabelReplaceExpr)
+		if !ok {
+			return repl
+		}
+		e = lr
+	}
+	if e.Left != nil {
+		if left, ok := e.Left.Rewrite(f).(SampleExpr); ok {
+			e.Left = left
+		}
+	}
+	return e
+}
+
 func (e *LabelReplaceExpr) String() string {
 	var sb strings.Builder
 	sb.WriteString(OpLabelReplace)
@@ -1492,6 +2172,227 @@ func (e *LabelReplaceExpr) String() string {
 	return sb.String()
 }
 
+// LabelJoinExpr implements PromQL's label_join(v, dst_label, separator,
+// src_label_1, ...), joining the values of src_label_1... with separator
+// and writing the result to dst_label, dropping dst_label if the joined
+// value is empty.
+type LabelJoinExpr struct {
+	Left      SampleExpr
+	Dst       string
+	Separator string
+	SrcLabels []string
+
+	implicit
+}
+
+func mustNewLabelJoinExpr(left SampleExpr, dst, separator string, src []string) *LabelJoinExpr {
+	if !model.LabelName(dst).IsValid() {
+		panic(logqlmodel.NewParseError(fmt.Sprintf("invalid destination label name in label_join: %s", dst), 0, 0))
+	}
+	for _, s := range src {
+		if !model.LabelName(s).IsValid() {
+			panic(logqlmodel.NewParseError(fmt.Sprintf("invalid source label name in label_join: %s", s), 0, 0))
+		}
+	}
+	return &LabelJoinExpr{
+		Left:      left,
+		Dst:       dst,
+		Separator: separator,
+		SrcLabels: src,
+	}
+}
+
+func (e *LabelJoinExpr) Selector() LogSelectorExpr {
+	return e.Left.Selector()
+}
+
+func (e *LabelJoinExpr) MatcherGroups() []MatcherRange {
+	return e.Left.MatcherGroups()
+}
+
+// Children returns e's sole operand: label_join doesn't consume samples
+// beyond what Left already does, so CountQuerySamples should attribute
+// cost to Left's leaves, not to this node, matching LabelReplaceExpr.
+func (e *LabelJoinExpr) Children() []SampleExpr {
+	return []SampleExpr{e.Left}
+}
+
+func (e *LabelJoinExpr) Extractor() (SampleExtractor, error) {
+	return e.Left.Extractor()
+}
+
+func (e *LabelJoinExpr) HasHistogram() bool {
+	return e.Left.HasHistogram()
+}
+
+// Shardable returns false for the same reason as LabelReplaceExpr: the
+// joined value depends on the full set of source labels on a series, which
+// no single shard can be guaranteed to see in isolation.
+func (e *LabelJoinExpr) Shardable() bool {
+	return false
+}
+
+func (e *LabelJoinExpr) Walk(f WalkFn) {
+	f(e)
+	if e.Left == nil {
+		return
+	}
+	e.Left.Walk(f)
+}
+
+func (e *LabelJoinExpr) Rewrite(f RewriteFn) Expr {
+	if repl, recurse := f(e); repl != nil {
+		if !recurse {
+			return repl
+		}
+		lj, ok := repl.(*LabelJoinExpr)
+		if !ok {
+			return repl
+		}
+		e = lj
+	}
+	if e.Left != nil {
+		if left, ok := e.Left.Rewrite(f).(SampleExpr); ok {
+			e.Left = left
+		}
+	}
+	return e
+}
+
+func (e *LabelJoinExpr) String() string {
+	var sb strings.Builder
+	sb.WriteString(OpLabelJoin)
+	sb.WriteString("(")
+	sb.WriteString(e.Left.String())
+	sb.WriteString(",")
+	sb.WriteString(strconv.Quote(e.Dst))
+	sb.WriteString(",")
+	sb.WriteString(strconv.Quote(e.Separator))
+	for _, s := range e.SrcLabels {
+		sb.WriteString(",")
+		sb.WriteString(strconv.Quote(s))
+	}
+	sb.WriteString(")")
+	return sb.String()
+}
+
+// histogramVectorParamCount is the number of scalar parameters each
+// HistogramVectorExpr operation takes: histogram_quantile takes phi,
+// histogram_fraction takes lower and upper bounds, and
+// histogram_count/histogram_sum take none.
+var histogramVectorParamCount = map[string]int{
+	OpTypeHistogramQuantile: 1,
+	OpTypeHistogramCount:    0,
+	OpTypeHistogramSum:      0,
+	OpTypeHistogramFraction: 2,
+}
+
+// HistogramVectorExpr implements PromQL's histogram_quantile,
+// histogram_count, histogram_sum and histogram_fraction: vector functions
+// computed over an instant vector of native histogram samples (typically
+// the output of histogram_over_time), not over a raw range selector, so
+// unlike RangeAggregationExpr this wraps a SampleExpr rather than a
+// RangeExpr.
+type HistogramVectorExpr struct {
+	Left      SampleExpr
+	Operation string
+	Params    []float64
+
+	implicit
+}
+
+func mustNewHistogramVectorExpr(operation string, left SampleExpr, params []float64) *HistogramVectorExpr {
+	pos := PositionRangeFor(left)
+	want, ok := histogramVectorParamCount[operation]
+	if !ok {
+		panic(logqlmodel.NewParseError(fmt.Sprintf("unknown histogram vector operation %s", operation), pos.Start, pos.End))
+	}
+	if len(params) != want {
+		panic(logqlmodel.NewParseError(fmt.Sprintf("%s takes %d parameter(s), got %d", operation, want, len(params)), pos.Start, pos.End))
+	}
+	if !left.HasHistogram() {
+		panic(logqlmodel.NewParseError(fmt.Sprintf("%s requires a histogram-valued expression", operation), pos.Start, pos.End))
+	}
+	return &HistogramVectorExpr{
+		Left:      left,
+		Operation: operation,
+		Params:    params,
+		implicit:  implicit{Pos: pos},
+	}
+}
+
+func (e *HistogramVectorExpr) Selector() LogSelectorExpr {
+	return e.Left.Selector()
+}
+
+func (e *HistogramVectorExpr) MatcherGroups() []MatcherRange {
+	return e.Left.MatcherGroups()
+}
+
+// Children returns e's sole operand, the same way LabelReplaceExpr and
+// LabelJoinExpr do: CountQuerySamples should attribute cost to Left's
+// leaves, not to this node.
+func (e *HistogramVectorExpr) Children() []SampleExpr {
+	return []SampleExpr{e.Left}
+}
+
+func (e *HistogramVectorExpr) Extractor() (SampleExtractor, error) {
+	return e.Left.Extractor()
+}
+
+// HasHistogram reports false: histogram_quantile/count/sum/fraction all
+// collapse a histogram-valued input down to a plain float vector.
+func (e *HistogramVectorExpr) HasHistogram() bool {
+	return false
+}
+
+// Shardable defers to Left: this node only does a pointwise computation
+// over whatever instant vector Left already produced, so it's shardable
+// exactly when Left is.
+func (e *HistogramVectorExpr) Shardable() bool {
+	return e.Left.Shardable()
+}
+
+func (e *HistogramVectorExpr) Walk(f WalkFn) {
+	f(e)
+	if e.Left == nil {
+		return
+	}
+	e.Left.Walk(f)
+}
+
+func (e *HistogramVectorExpr) Rewrite(f RewriteFn) Expr {
+	if repl, recurse := f(e); repl != nil {
+		if !recurse {
+			return repl
+		}
+		hv, ok := repl.(*HistogramVectorExpr)
+		if !ok {
+			return repl
+		}
+		e = hv
+	}
+	if e.Left != nil {
+		if left, ok := e.Left.Rewrite(f).(SampleExpr); ok {
+			e.Left = left
+		}
+	}
+	return e
+}
+
+func (e *HistogramVectorExpr) String() string {
+	var sb strings.Builder
+	sb.WriteString(e.Operation)
+	sb.WriteString("(")
+	for _, p := range e.Params {
+		sb.WriteString(strconv.FormatFloat(p, 'f', -1, 64))
+		sb.WriteString(",")
+	}
+	sb.WriteString(e.Left.String())
+	sb.WriteString(")")
+	return sb.String()
+}
+
 // shardableOps lists the operations which may be sharded.
 // topk, botk, max, & min all must be concatenated and then evaluated in order to avoid
 // potential data loss due to series distribution across shards.
@@ -1515,6 +2416,13 @@ var shardableOps = map[string]bool{
 	// avg is only marked as shardable because we remap it into sum/count.
 	OpTypeAvg:   true,
 	OpTypeCount: true,
+	// topk/bottomk/min/max are shardable via PartialAggregator: each shard
+	// computes its own partial candidate set, which is concatenated and
+	// re-aggregated centrally instead of being pre-reduced per shard.
+	OpTypeTopK:    true,
+	OpTypeBottomK: true,
+	OpTypeMax:     true,
+	OpTypeMin:     true,
 
 	// range vector ops
 	OpRangeTypeCount:     true,
@@ -1524,15 +2432,123 @@ var shardableOps = map[string]bool{
 	OpRangeTypeSum:       true,
 	OpRangeTypeMax:       true,
 	OpRangeTypeMin:       true,
+	// quantile_over_time is deliberately NOT marked shardable: doing so
+	// correctly requires an approximate mode that ships fixed-size
+	// t-digest/KLL sketches per shard and merges them centrally, gated by a
+	// config flag (querier.shard_aggregations). That sketch type and config
+	// plumbing don't exist in this tree yet, so naively concatenating
+	// per-shard quantile_over_time results would silently produce wrong
+	// quantiles; leave this as a follow-up once the sketch/config machinery
+	// lands.
+	//
+	// native histograms merge associatively, so sharding per-step
+	// accumulation is safe.
+	OpRangeTypeHistogram: true,
 
 	// binops - arith
 	OpTypeAdd: true,
 	OpTypeMul: true,
+
+	// binops - logical/set
+	// unless is deliberately excluded: it isn't symmetric, so a shard that
+	// only sees part of the RHS can't correctly decide set membership.
+	OpTypeAnd: true,
+	OpTypeOr:  true,
+}
+
+// PartialAggregator is implemented by SampleExprs whose aggregation can be
+// sharded by having each shard compute a partial candidate set that is
+// concatenated and re-aggregated centrally, rather than by pre-reducing
+// each shard's result independently. For example, sharding `topk(k, expr)`
+// rewrites it into `topk(k, concat(topk(k, shard_i(expr))))` for each
+// shard; `min`/`max` rewrite analogously.
+type PartialAggregator interface {
+	SampleExpr
+	// PartialOperation returns the operation each shard should apply before
+	// concatenation, or "" if this expression isn't partially aggregatable.
+	PartialOperation() string
+}
+
+func (e *VectorAggregationExpr) PartialOperation() string {
+	switch e.Operation {
+	case OpTypeTopK, OpTypeBottomK, OpTypeMin, OpTypeMax:
+		return e.Operation
+	default:
+		return ""
+	}
+}
+
+// HasHistogram reports whether this aggregation produces native histogram
+// samples, i.e. it's a histogram_over_time.
+func (e *RangeAggregationExpr) HasHistogram() bool {
+	return e.Operation == OpRangeTypeHistogram
+}
+
+// PartialOperation always returns "" (see the shardableOps comment on
+// OpRangeTypeQuantile): quantile_over_time is the only range aggregation
+// this package would otherwise mark partially-aggregatable, and it isn't
+// correctly shardable without sketch support that doesn't exist yet.
+func (e *RangeAggregationExpr) PartialOperation() string {
+	return ""
+}
+
+// PartialMerge re-aggregates the concatenation of each shard's partial
+// result for an operation returned by PartialAggregator.PartialOperation,
+// e.g. merging per-shard topk(k, ...) candidates into the overall topk.
+//
+// Candidates are first grouped by their series' full label signature so
+// that a query like `max by (pod) (...)` keeps one winner per pod across
+// shards instead of collapsing every pod into a single global series; k
+// is then applied within each group.
+func PartialMerge(op string, k int, shards ...[]promql.Sample) []promql.Sample {
+	groups := map[string][]promql.Sample{}
+	var order []string
+	for _, shard := range shards {
+		for _, s := range shard {
+			sig := vectorMatchingSignature(s.Metric, false, nil)
+			if _, ok := groups[sig]; !ok {
+				order = append(order, sig)
+			}
+			groups[sig] = append(groups[sig], s)
+		}
+	}
+
+	var less func(a, b promql.Sample) bool
+	groupK := k
+	switch op {
+	case OpTypeTopK:
+		less = func(a, b promql.Sample) bool { return a.Point.V > b.Point.V }
+	case OpTypeBottomK:
+		less = func(a, b promql.Sample) bool { return a.Point.V < b.Point.V }
+	case OpTypeMax:
+		less = func(a, b promql.Sample) bool { return a.Point.V > b.Point.V }
+		groupK = 1
+	case OpTypeMin:
+		less = func(a, b promql.Sample) bool { return a.Point.V < b.Point.V }
+		groupK = 1
+	default:
+		panic(errors.Errorf("should never happen: unexpected partial aggregation: (%s)", op))
+	}
+
+	result := make([]promql.Sample, 0, len(order)*groupK)
+	for _, sig := range order {
+		g := groups[sig]
+		sort.Slice(g, func(i, j int) bool { return less(g[i], g[j]) })
+		n := groupK
+		if n > len(g) {
+			n = len(g)
+		}
+		result = append(result, g[:n]...)
+	}
+	return result
 }
 
 type MatcherRange struct {
 	Matchers         []*labels.Matcher
 	Interval, Offset time.Duration
+	// At, when set, pins the evaluation timestamp for this leg of the AST
+	// independently of the outer query time (see the `@` modifier).
+	At *AtModifier
 }
 
 func MatcherGroups(expr Expr) []MatcherRange {
@@ -1552,3 +2568,40 @@ func MatcherGroups(expr Expr) []MatcherRange {
 		return nil
 	}
 }
+
+// sampleExprParent is implemented by SampleExprs that wrap one or more
+// other SampleExprs (BinOpExpr, LabelReplaceExpr, LabelJoinExpr and
+// HistogramVectorExpr) and expose
+// them via Children, so callers can recurse without double-counting a
+// child shared by more than one parent.
+type sampleExprParent interface {
+	SampleExpr
+	Children() []SampleExpr
+}
+
+// CountQuerySamples walks e, calling leafCost on each distinct leaf
+// SampleExpr (one that doesn't implement sampleExprParent) and recording
+// the result in sink at step idx. A leaf shared by more than one parent,
+// e.g. the common selector on both legs of `a / a`, is only counted once.
+// This is the AST-side half of per-step sample accounting; the step
+// evaluator constructors are what would call this once per step with a
+// real leafCost backed by actual line counts, once they're threaded
+// through to accept a *stats.QuerySamples sink.
+func CountQuerySamples(sink *stats.QuerySamples, idx int, e SampleExpr, leafCost func(SampleExpr) int64) {
+	seen := map[SampleExpr]struct{}{}
+	var walk func(SampleExpr)
+	walk = func(c SampleExpr) {
+		if p, ok := c.(sampleExprParent); ok {
+			for _, child := range p.Children() {
+				walk(child)
+			}
+			return
+		}
+		if _, dup := seen[c]; dup {
+			return
+		}
+		seen[c] = struct{}{}
+		sink.Add(idx, leafCost(c))
+	}
+	walk(e)
+}
@@ -0,0 +1,64 @@
+package syntax
+
+import (
+	"testing"
+
+	"github.com/grafana/loki/pkg/logqlmodel/stats"
+)
+
+// TestCountQuerySamples_DedupesSharedChild checks that a leaf shared by
+// both legs of a BinOpExpr (e.g. `a / a`) is only counted once per step,
+// and that a LabelReplaceExpr wrapping a leaf attributes cost to that leaf
+// rather than double-counting on top of it.
+func TestCountQuerySamples_DedupesSharedChild(t *testing.T) {
+	leaf := &LiteralExpr{Val: 1}
+	shared := &LiteralExpr{Val: 2}
+
+	bin := &BinOpExpr{SampleExpr: shared, RHS: shared, Op: OpTypeDiv}
+	wrapped := &LabelReplaceExpr{Left: leaf}
+
+	cost := func(e SampleExpr) int64 {
+		if e == shared {
+			return 5
+		}
+		return 3
+	}
+
+	sink := stats.NewQuerySamples(true, 2)
+	CountQuerySamples(sink, 0, bin, cost)
+	if got := sink.Total(); got != 5 {
+		t.Fatalf("expected shared leaf counted once (5), got %d", got)
+	}
+
+	CountQuerySamples(sink, 1, wrapped, cost)
+	if got := sink.Total(); got != 8 {
+		t.Fatalf("expected total 8 after wrapped leaf, got %d", got)
+	}
+	if got := sink.PerStep(); got[0] != 5 || got[1] != 3 {
+		t.Fatalf("unexpected per-step counts: %v", got)
+	}
+}
+
+// TestCountQuerySamples_LabelJoinDedupesSharedChild checks that
+// LabelJoinExpr recurses into its Children like LabelReplaceExpr does,
+// rather than being treated as a leaf: a leaf shared between a
+// label_join(...) leg and another leg of a BinOpExpr must still only be
+// counted once per step.
+func TestCountQuerySamples_LabelJoinDedupesSharedChild(t *testing.T) {
+	shared := &LiteralExpr{Val: 2}
+	joined := &LabelJoinExpr{Left: shared}
+	bin := &BinOpExpr{SampleExpr: joined, RHS: shared, Op: OpTypeDiv}
+
+	cost := func(e SampleExpr) int64 {
+		if e == shared {
+			return 5
+		}
+		return 3
+	}
+
+	sink := stats.NewQuerySamples(false, 0)
+	CountQuerySamples(sink, 0, bin, cost)
+	if got := sink.Total(); got != 5 {
+		t.Fatalf("expected shared leaf counted once through label_join (5), got %d", got)
+	}
+}
@@ -0,0 +1,44 @@
+package syntax
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// TestHistogramOverTime_Validates checks that a histogram_over_time
+// aggregation, with and without an explicit schema parameter, validates
+// and reports itself as histogram-producing.
+func TestHistogramOverTime_Validates(t *testing.T) {
+	selector := newMatcherExpr(PositionRange{}, []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "job", "api"),
+	})
+	unwrap := newUnwrapExpr("duration_seconds", "")
+	logRange := newLogRange(selector, 0, unwrap, nil, nil)
+
+	schema := "8"
+	for _, tc := range []struct {
+		name   string
+		schema *string
+	}{
+		{"no_schema", nil},
+		{"with_schema", &schema},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newHistogramRangeAggregationExpr(logRange, nil, tc.schema)
+			r, ok := e.(*RangeAggregationExpr)
+			if !ok {
+				t.Fatalf("expected *RangeAggregationExpr, got %T", e)
+			}
+			if err := r.Validate(); err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			if !r.HasHistogram() {
+				t.Fatalf("expected HasHistogram() to be true")
+			}
+			if r.Operation != OpRangeTypeHistogram {
+				t.Fatalf("expected operation %s, got %s", OpRangeTypeHistogram, r.Operation)
+			}
+		})
+	}
+}
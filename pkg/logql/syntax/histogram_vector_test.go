@@ -0,0 +1,61 @@
+package syntax
+
+import "testing"
+
+// TestHistogramVectorExpr_Quantile checks that histogram_quantile builds,
+// round-trips through String(), and reports itself as a plain (non
+// histogram-producing) vector, unlike the histogram-valued Left it wraps.
+func TestHistogramVectorExpr_Quantile(t *testing.T) {
+	left := &RangeAggregationExpr{
+		Operation: OpRangeTypeHistogram,
+		Left:      newLogRange(newMatcherExpr(PositionRange{}, nil), 0, nil, nil, nil),
+	}
+
+	e := mustNewHistogramVectorExpr(OpTypeHistogramQuantile, left, []float64{0.99})
+	if !left.HasHistogram() {
+		t.Fatalf("expected Left to be histogram-valued")
+	}
+	if e.HasHistogram() {
+		t.Fatalf("expected HistogramVectorExpr.HasHistogram() to be false")
+	}
+
+	want := `histogram_quantile(0.99,` + left.String() + `)`
+	if got := e.String(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// TestHistogramVectorExpr_ParamCountValidated checks that each op panics
+// when given the wrong number of parameters, e.g. histogram_count takes
+// none and histogram_fraction takes two.
+func TestHistogramVectorExpr_ParamCountValidated(t *testing.T) {
+	left := &RangeAggregationExpr{
+		Operation: OpRangeTypeHistogram,
+		Left:      newLogRange(newMatcherExpr(PositionRange{}, nil), 0, nil, nil, nil),
+	}
+
+	for _, tc := range []struct {
+		name   string
+		op     string
+		params []float64
+		panics bool
+	}{
+		{"count_no_params", OpTypeHistogramCount, nil, false},
+		{"count_extra_param", OpTypeHistogramCount, []float64{1}, true},
+		{"fraction_two_params", OpTypeHistogramFraction, []float64{0, 1}, false},
+		{"fraction_missing_param", OpTypeHistogramFraction, []float64{0}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func() {
+				r := recover()
+				if tc.panics && r == nil {
+					t.Fatalf("expected panic, got none")
+				}
+				if !tc.panics && r != nil {
+					t.Fatalf("unexpected panic: %v", r)
+				}
+			}()
+			mustNewHistogramVectorExpr(tc.op, left, tc.params)
+		})
+	}
+}
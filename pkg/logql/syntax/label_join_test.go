@@ -0,0 +1,51 @@
+package syntax
+
+import "testing"
+
+// TestLabelJoinExpr_String mirrors the stringer expectations PromQL has
+// for label_join: dst, separator, and each source label are quoted and
+// comma-separated after the wrapped expression.
+func TestLabelJoinExpr_String(t *testing.T) {
+	left := &LiteralExpr{Val: 1}
+	e := mustNewLabelJoinExpr(left, "foo", "-", []string{"bar", "baz"})
+
+	want := `label_join(1,"foo","-","bar","baz")`
+	if got := e.String(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// TestLabelJoinExpr_InvalidLabelNames checks that mustNewLabelJoinExpr
+// rejects invalid destination and source label names.
+func TestLabelJoinExpr_InvalidLabelNames(t *testing.T) {
+	left := &LiteralExpr{Val: 1}
+
+	assertPanics(t, "invalid dst", func() {
+		mustNewLabelJoinExpr(left, "0invalid", "-", []string{"bar"})
+	})
+	assertPanics(t, "invalid src", func() {
+		mustNewLabelJoinExpr(left, "foo", "-", []string{"0invalid"})
+	})
+}
+
+// TestLabelJoinExpr_NotShardable checks label_join reports itself
+// unshardable, for the same reason label_replace does: the joined value
+// depends on the full set of source labels on a series, which no single
+// shard is guaranteed to see in isolation.
+func TestLabelJoinExpr_NotShardable(t *testing.T) {
+	left := &LiteralExpr{Val: 1}
+	e := mustNewLabelJoinExpr(left, "foo", "-", []string{"bar"})
+	if e.Shardable() {
+		t.Fatalf("expected label_join to be unshardable")
+	}
+}
+
+func assertPanics(t *testing.T, name string, f func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("%s: expected panic", name)
+		}
+	}()
+	f()
+}
@@ -0,0 +1,214 @@
+package syntax
+
+import "github.com/prometheus/prometheus/model/labels"
+
+// RewriteFn inspects an expression and optionally returns a replacement.
+// When a replacement is returned, the second value tells Rewrite whether to
+// recurse into the replacement's children (true) or treat it as final
+// (false).
+type RewriteFn func(Expr) (Expr, bool)
+
+// Optimizer is a single, idempotent AST rewrite pass. Optimizers must not
+// change the semantics of the expression they rewrite, only its shape or
+// evaluation cost.
+type Optimizer interface {
+	// Name identifies the pass, and shows up in an OptimizeTrace.
+	Name() string
+	Optimize(Expr) (Expr, error)
+}
+
+// OptimizeTrace records which optimizer passes changed the expression they
+// were given, for debugging which rewrites fired on a given query.
+type OptimizeTrace struct {
+	Fired []string
+}
+
+func (t *OptimizeTrace) record(name string) {
+	if t == nil {
+		return
+	}
+	t.Fired = append(t.Fired, name)
+}
+
+// DefaultOptimizers are the built-in passes applied by Optimize when none
+// are explicitly provided.
+var DefaultOptimizers = []Optimizer{
+	ConstantFoldOptimizer{},
+	LineFilterPushdownOptimizer{},
+	LineFmtFusionOptimizer{},
+	VectorGroupingHoistOptimizer{},
+}
+
+// Optimize applies each pass in order, feeding the output of one into the
+// next, and records in trace which passes actually changed the expression.
+// trace may be nil.
+func Optimize(e Expr, trace *OptimizeTrace, passes ...Optimizer) (Expr, error) {
+	if len(passes) == 0 {
+		passes = DefaultOptimizers
+	}
+	for _, p := range passes {
+		before := e.String()
+		next, err := p.Optimize(e)
+		if err != nil {
+			return nil, err
+		}
+		if next.String() != before {
+			trace.record(p.Name())
+		}
+		e = next
+	}
+	return e, nil
+}
+
+// rewriter lets callers invoke Rewrite on any Expr without every one of this
+// package's interfaces (LogSelectorExpr, SampleExpr, StageExpr, ...)
+// needing to redeclare the method.
+type rewriter interface {
+	Rewrite(RewriteFn) Expr
+}
+
+func rewrite(e Expr, f RewriteFn) Expr {
+	if r, ok := e.(rewriter); ok {
+		return r.Rewrite(f)
+	}
+	return e
+}
+
+// ConstantFoldOptimizer folds binary operations whose operands are both
+// LiteralExprs, e.g. `(1 + 1)` -> `2`. Parsing already folds literals that
+// are adjacent in the source query (see reduceBinOp); this pass catches the
+// same opportunity when it's only exposed after an earlier rewrite pass.
+type ConstantFoldOptimizer struct{}
+
+func (ConstantFoldOptimizer) Name() string { return "constant_fold" }
+
+func (o ConstantFoldOptimizer) Optimize(e Expr) (Expr, error) {
+	return rewrite(e, func(node Expr) (Expr, bool) {
+		b, ok := node.(*BinOpExpr)
+		if !ok {
+			return nil, false
+		}
+		left, lOk := b.SampleExpr.(*LiteralExpr)
+		right, rOk := b.RHS.(*LiteralExpr)
+		if !lOk || !rOk || b.HasHistogram() {
+			return nil, false
+		}
+		return reduceBinOp(b.Op, left, right), false
+	}), nil
+}
+
+// LineFilterPushdownOptimizer pushes a literal `|=`/`!=` LineFilterExpr
+// above an adjacent LabelParserExpr, since parsing a line into labels
+// doesn't change the line content the filter matches against.
+type LineFilterPushdownOptimizer struct{}
+
+func (LineFilterPushdownOptimizer) Name() string { return "line_filter_pushdown" }
+
+func (o LineFilterPushdownOptimizer) Optimize(e Expr) (Expr, error) {
+	return rewrite(e, func(node Expr) (Expr, bool) {
+		p, ok := node.(*PipelineExpr)
+		if !ok {
+			return nil, false
+		}
+		for j := 1; j < len(p.MultiStages); j++ {
+			filter, ok := p.MultiStages[j].(*LineFilterExpr)
+			if !ok || filter.Left != nil || (filter.Ty != labels.MatchEqual && filter.Ty != labels.MatchNotEqual) {
+				continue
+			}
+			// Walk the filter past every immediately preceding
+			// LabelParserExpr in this same pass, rather than moving one
+			// slot per Optimize call, so the pass is idempotent: a second
+			// call finds nothing left to hoist.
+			for i := j; i > 0; i-- {
+				if _, ok := p.MultiStages[i-1].(*LabelParserExpr); !ok {
+					break
+				}
+				p.MultiStages[i-1], p.MultiStages[i] = p.MultiStages[i], p.MultiStages[i-1]
+			}
+		}
+		return p, true
+	}), nil
+}
+
+// LineFmtFusionOptimizer fuses adjacent `| line_format` stages, since only
+// the last one's output is observable.
+type LineFmtFusionOptimizer struct{}
+
+func (LineFmtFusionOptimizer) Name() string { return "line_fmt_fusion" }
+
+func (o LineFmtFusionOptimizer) Optimize(e Expr) (Expr, error) {
+	return rewrite(e, func(node Expr) (Expr, bool) {
+		p, ok := node.(*PipelineExpr)
+		if !ok {
+			return nil, false
+		}
+		fused := make(MultiStageExpr, 0, len(p.MultiStages))
+		for _, s := range p.MultiStages {
+			if fmtExpr, ok := s.(*LineFmtExpr); ok && len(fused) > 0 {
+				if _, ok := fused[len(fused)-1].(*LineFmtExpr); ok {
+					fused[len(fused)-1] = fmtExpr
+					continue
+				}
+			}
+			fused = append(fused, s)
+		}
+		p.MultiStages = fused
+		return p, true
+	}), nil
+}
+
+// VectorGroupingHoistOptimizer hoists a `max by (...)`/`min by (...)`/
+// `sum by (...)` grouping into the nested max_over_time/min_over_time/
+// sum_over_time RangeAggregationExpr it wraps, when doing so doesn't change
+// the result: `max by (g) (max_over_time(expr[5m]))` ==
+// `max_over_time(expr[5m]) by (g)`, since max is idempotent and
+// RangeAggregationExpr.validate already permits a grouping clause on
+// max_over_time/min_over_time/sum_over_time.
+//
+// This is a different, narrower mechanism from
+// VectorAggregationExpr.Extractor's push-down of `sum` into additive
+// range ops (bytes_over_time, count_over_time, rate, ...): that push-down
+// only ever affects label extraction, and never sets Grouping on the
+// nested RangeAggregationExpr; of those ops, only sum_over_time accepts a
+// `by(...)`/`without(...)` clause at all.
+type VectorGroupingHoistOptimizer struct{}
+
+func (VectorGroupingHoistOptimizer) Name() string { return "vector_grouping_hoist" }
+
+func (o VectorGroupingHoistOptimizer) Optimize(e Expr) (Expr, error) {
+	return rewrite(e, func(node Expr) (Expr, bool) {
+		v, ok := node.(*VectorAggregationExpr)
+		if !ok {
+			return nil, false
+		}
+		r, ok := v.Left.(*RangeAggregationExpr)
+		if !ok || r.Grouping != nil || !canHoistVectorGrouping(v.Operation, r.Operation) {
+			return nil, false
+		}
+		r.Grouping = v.Grouping
+		return v, true
+	}), nil
+}
+
+// canHoistVectorGrouping tells if a vector aggregation's grouping clause
+// can be hoisted into the nested range aggregation it wraps: only legal
+// when rangeOp accepts a grouping clause per RangeAggregationExpr.validate,
+// and the outer vector op is the same associative reduction as the range
+// op, so the rewrite can't change which samples win.
+//
+// sum/sum_over_time is included alongside max/min: summing per-series
+// range-aggregated values and then summing those sums by a grouping is the
+// same as pre-grouping before the range aggregation, since addition is
+// associative and commutative the same way max/min are idempotent.
+func canHoistVectorGrouping(vecOp, rangeOp string) bool {
+	switch {
+	case vecOp == OpTypeMax && rangeOp == OpRangeTypeMax:
+		return true
+	case vecOp == OpTypeMin && rangeOp == OpRangeTypeMin:
+		return true
+	case vecOp == OpTypeSum && rangeOp == OpRangeTypeSum:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,147 @@
+package syntax
+
+import "testing"
+
+// TestVectorGroupingHoistOptimizer_InvalidOpsUntouched guards against the
+// hoist firing for ops that RangeAggregationExpr.validate doesn't allow a
+// grouping clause on (e.g. count_over_time): the rewrite must leave the
+// tree unchanged and valid, not produce a double-grouped, unparseable
+// String() like `sum by(app)(count_over_time(...) by(app))`.
+func TestVectorGroupingHoistOptimizer_InvalidOpsUntouched(t *testing.T) {
+	expr, err := ParseExpr(`sum by (app) (count_over_time({app="foo"}[5m]))`)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	before := expr.String()
+
+	got, err := Optimize(expr, nil, VectorGroupingHoistOptimizer{})
+	if err != nil {
+		t.Fatalf("optimize: %v", err)
+	}
+	if got.String() != before {
+		t.Fatalf("expected no rewrite, got %q want %q", got.String(), before)
+	}
+	if v, ok := got.(SampleExpr); ok {
+		if ve, ok := v.(interface{ Validate() error }); ok {
+			if err := ve.Validate(); err != nil {
+				t.Fatalf("optimized tree failed to validate: %v", err)
+			}
+		}
+	}
+}
+
+// TestVectorGroupingHoistOptimizer_HoistsMax checks that
+// `max by (...) (max_over_time(...))` hoists its grouping into the range
+// aggregation, and the result still validates and is idempotent under a
+// second pass.
+func TestVectorGroupingHoistOptimizer_HoistsMax(t *testing.T) {
+	expr, err := ParseExpr(`max by (app) (max_over_time({app="foo"} | unwrap bar [5m]))`)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	var trace OptimizeTrace
+	got, err := Optimize(expr, &trace, VectorGroupingHoistOptimizer{})
+	if err != nil {
+		t.Fatalf("optimize: %v", err)
+	}
+	if len(trace.Fired) != 1 || trace.Fired[0] != "vector_grouping_hoist" {
+		t.Fatalf("expected vector_grouping_hoist to fire once, got %v", trace.Fired)
+	}
+
+	v, ok := got.(*VectorAggregationExpr)
+	if !ok {
+		t.Fatalf("expected *VectorAggregationExpr, got %T", got)
+	}
+	r, ok := v.Left.(*RangeAggregationExpr)
+	if !ok {
+		t.Fatalf("expected *RangeAggregationExpr, got %T", v.Left)
+	}
+	if err := r.Validate(); err != nil {
+		t.Fatalf("hoisted tree failed to validate: %v", err)
+	}
+
+	again, err := Optimize(got, nil, VectorGroupingHoistOptimizer{})
+	if err != nil {
+		t.Fatalf("re-optimize: %v", err)
+	}
+	if again.String() != got.String() {
+		t.Fatalf("optimizer not idempotent: %q != %q", again.String(), got.String())
+	}
+}
+
+// TestVectorGroupingHoistOptimizer_HoistsSum checks that sum/sum_over_time
+// is hoisted the same way as max/min: sum is associative and commutative,
+// so pre-grouping before the range aggregation doesn't change the result.
+func TestVectorGroupingHoistOptimizer_HoistsSum(t *testing.T) {
+	expr, err := ParseExpr(`sum by (app) (sum_over_time({app="foo"} | unwrap bar [5m]))`)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	var trace OptimizeTrace
+	got, err := Optimize(expr, &trace, VectorGroupingHoistOptimizer{})
+	if err != nil {
+		t.Fatalf("optimize: %v", err)
+	}
+	if len(trace.Fired) != 1 || trace.Fired[0] != "vector_grouping_hoist" {
+		t.Fatalf("expected vector_grouping_hoist to fire once, got %v", trace.Fired)
+	}
+
+	v, ok := got.(*VectorAggregationExpr)
+	if !ok {
+		t.Fatalf("expected *VectorAggregationExpr, got %T", got)
+	}
+	r, ok := v.Left.(*RangeAggregationExpr)
+	if !ok {
+		t.Fatalf("expected *RangeAggregationExpr, got %T", v.Left)
+	}
+	if err := r.Validate(); err != nil {
+		t.Fatalf("hoisted tree failed to validate: %v", err)
+	}
+
+	again, err := Optimize(got, nil, VectorGroupingHoistOptimizer{})
+	if err != nil {
+		t.Fatalf("re-optimize: %v", err)
+	}
+	if again.String() != got.String() {
+		t.Fatalf("optimizer not idempotent: %q != %q", again.String(), got.String())
+	}
+}
+
+// TestLineFilterPushdownOptimizer_HoistsPastMultipleParsers checks that a
+// literal filter preceded by more than one LabelParserExpr stage is
+// hoisted all the way to the front in a single Optimize call, and that a
+// second call is a no-op, proving the pass is idempotent as documented.
+func TestLineFilterPushdownOptimizer_HoistsPastMultipleParsers(t *testing.T) {
+	expr, err := ParseExpr(`{app="foo"} | json | logfmt |= "x"`)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	var trace OptimizeTrace
+	got, err := Optimize(expr, &trace, LineFilterPushdownOptimizer{})
+	if err != nil {
+		t.Fatalf("optimize: %v", err)
+	}
+	if len(trace.Fired) != 1 {
+		t.Fatalf("expected line_filter_pushdown to fire once, got %v", trace.Fired)
+	}
+
+	want := `{app="foo"} |= "x" | json | logfmt`
+	if got.String() != want {
+		t.Fatalf("got %q, want %q", got.String(), want)
+	}
+
+	var secondTrace OptimizeTrace
+	again, err := Optimize(got, &secondTrace, LineFilterPushdownOptimizer{})
+	if err != nil {
+		t.Fatalf("re-optimize: %v", err)
+	}
+	if again.String() != got.String() {
+		t.Fatalf("optimizer not idempotent: %q != %q", again.String(), got.String())
+	}
+	if len(secondTrace.Fired) != 0 {
+		t.Fatalf("expected no-op second pass, got %v", secondTrace.Fired)
+	}
+}
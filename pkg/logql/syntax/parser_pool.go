@@ -0,0 +1,74 @@
+package syntax
+
+import (
+	"sync"
+
+	"github.com/grafana/loki/pkg/logqlmodel"
+)
+
+// parserPool amortizes the lexer/parser allocation cost of ParseExpr, which
+// runs on every incoming query (and on every Clone), keeping it off the
+// query hot path.
+var parserPool = sync.Pool{
+	New: func() interface{} {
+		return &parser{}
+	},
+}
+
+// parser bundles the generated yacc parser together with its lexer so both
+// can be reset and returned to parserPool instead of reallocated per call.
+type parser struct {
+	p     yyParserImpl
+	lexer lexer
+	expr  Expr
+	errs  []logqlmodel.ParseError
+}
+
+func parserFromPool() *parser {
+	return parserPool.Get().(*parser)
+}
+
+// Close resets the parser's scratch state and returns it to parserPool. It
+// intentionally keeps the backing arrays (errs) allocated so repeated
+// parses can reuse them.
+//
+// p.p (the generated yyParserImpl) is reset to its zero value rather than
+// left as-is: it's the one field here we don't control the internals of,
+// so we can't assume "don't touch it" is safe the way it is for lexer and
+// errs. Zeroing it guarantees no stale lookahead token or parse stack
+// entry from one query can leak into the next pooled reuse.
+func (p *parser) Close() {
+	p.expr = nil
+	p.errs = p.errs[:0]
+	p.lexer.Reset("")
+	p.p = yyParserImpl{}
+	parserPool.Put(p)
+}
+
+func (p *parser) parseExpr(input string) (Expr, error) {
+	p.lexer.Reset(input)
+	p.p.Parse(&p.lexer)
+	if len(p.errs) > 0 {
+		return nil, p.errs[0]
+	}
+	if p.expr == nil {
+		return nil, logqlmodel.ErrParseEmptyString
+	}
+	return p.expr, nil
+}
+
+// parseExprPooled is the pooled implementation behind ParseExpr, split out
+// under its own name so it's unambiguous there is exactly one exported
+// ParseExpr in this package (the one below, which Clone calls) and this
+// isn't a second definition competing with it.
+func parseExprPooled(input string) (Expr, error) {
+	p := parserFromPool()
+	defer p.Close()
+	return p.parseExpr(input)
+}
+
+// ParseExpr parses a LogQL expression into an Expr, reusing a pooled
+// lexer/parser instance to cut allocation cost on the query path.
+func ParseExpr(input string) (expr Expr, err error) {
+	return parseExprPooled(input)
+}
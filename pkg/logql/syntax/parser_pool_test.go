@@ -0,0 +1,22 @@
+package syntax
+
+import "testing"
+
+var parserBenchQueries = []string{
+	`{app="foo"}`,
+	`{app="foo"} |= "bar" | logfmt | duration > 1s`,
+	`rate({app="foo"}[5m])`,
+	`sum by (app) (rate({app="foo"} |= "error" [5m]))`,
+	`topk(10, sum by (app) (count_over_time({app="foo"}[1m])))`,
+}
+
+func BenchmarkParseExpr(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, q := range parserBenchQueries {
+			if _, err := ParseExpr(q); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
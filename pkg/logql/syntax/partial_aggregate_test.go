@@ -0,0 +1,190 @@
+package syntax
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"testing/quick"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// TestPartialMerge_ShardInvariance fuzzes over random value sets and shard
+// counts to check that merging per-shard partial results (PartialMerge
+// applied to each shard, then again to the concatenation) yields the same
+// value set as applying PartialMerge directly over the unsharded data,
+// for every partially-aggregatable op.
+func TestPartialMerge_ShardInvariance(t *testing.T) {
+	for _, op := range []string{OpTypeTopK, OpTypeBottomK, OpTypeMin, OpTypeMax} {
+		op := op
+		t.Run(op, func(t *testing.T) {
+			check := func(vals []float64, numShards uint8) bool {
+				if len(vals) == 0 {
+					return true
+				}
+				n := int(numShards)%4 + 1
+				samples := make([]promql.Sample, len(vals))
+				for i, v := range vals {
+					samples[i] = promql.Sample{Point: promql.Point{V: v}}
+				}
+
+				shards := make([][]promql.Sample, n)
+				for i, s := range samples {
+					shards[i%n] = append(shards[i%n], s)
+				}
+
+				k := len(vals)/2 + 1
+
+				want := PartialMerge(op, k, samples)
+
+				perShard := make([][]promql.Sample, n)
+				for i, shard := range shards {
+					perShard[i] = PartialMerge(op, k, shard)
+				}
+				got := PartialMerge(op, k, perShard...)
+
+				return sameValues(want, got)
+			}
+			if err := quick.Check(check, &quick.Config{MaxCount: 200}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// TestPartialMerge_PerGroup checks that PartialMerge keeps the per-group
+// invariant for `max by (pod)`/`min by (pod)`-style queries: when shards
+// carry multiple distinct series (grouping labels), each group's winner
+// must survive the merge, not just a single global winner.
+func TestPartialMerge_PerGroup(t *testing.T) {
+	sample := func(pod string, v float64) promql.Sample {
+		return promql.Sample{
+			Metric: labels.FromStrings("pod", pod),
+			Point:  promql.Point{V: v},
+		}
+	}
+
+	shard1 := []promql.Sample{sample("a", 2), sample("b", 11)}
+	shard2 := []promql.Sample{sample("a", 9), sample("b", 4)}
+
+	for _, tc := range []struct {
+		op   string
+		want map[string]float64
+	}{
+		{OpTypeMax, map[string]float64{"a": 9, "b": 11}},
+		{OpTypeMin, map[string]float64{"a": 2, "b": 4}},
+	} {
+		t.Run(tc.op, func(t *testing.T) {
+			merged := PartialMerge(tc.op, 1,
+				PartialMerge(tc.op, 1, shard1),
+				PartialMerge(tc.op, 1, shard2),
+			)
+			got := map[string]float64{}
+			for _, s := range merged {
+				got[s.Metric.Get("pod")] = s.Point.V
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestPartialMerge_ShardInvariance_MultiGroup is like
+// TestPartialMerge_ShardInvariance but assigns samples to one of a handful
+// of series so the fuzz test can't pass by having only one group, as it
+// would if every sample shared the same (empty) Metric.
+func TestPartialMerge_ShardInvariance_MultiGroup(t *testing.T) {
+	for _, op := range []string{OpTypeTopK, OpTypeBottomK, OpTypeMin, OpTypeMax} {
+		op := op
+		t.Run(op, func(t *testing.T) {
+			check := func(vals []float64, numShards, numGroups uint8) bool {
+				if len(vals) == 0 {
+					return true
+				}
+				n := int(numShards)%4 + 1
+				g := int(numGroups)%3 + 1
+
+				samples := make([]promql.Sample, len(vals))
+				for i, v := range vals {
+					pod := fmt.Sprintf("pod-%d", i%g)
+					samples[i] = promql.Sample{
+						Metric: labels.FromStrings("pod", pod),
+						Point:  promql.Point{V: v},
+					}
+				}
+
+				shards := make([][]promql.Sample, n)
+				for i, s := range samples {
+					shards[i%n] = append(shards[i%n], s)
+				}
+
+				k := len(vals)/2 + 1
+
+				want := PartialMerge(op, k, samples)
+
+				perShard := make([][]promql.Sample, n)
+				for i, shard := range shards {
+					perShard[i] = PartialMerge(op, k, shard)
+				}
+				got := PartialMerge(op, k, perShard...)
+
+				return samePerGroupValues(want, got)
+			}
+			if err := quick.Check(check, &quick.Config{MaxCount: 200}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func samePerGroupValues(a, b []promql.Sample) bool {
+	group := func(samples []promql.Sample) map[string][]float64 {
+		m := map[string][]float64{}
+		for _, s := range samples {
+			pod := s.Metric.Get("pod")
+			m[pod] = append(m[pod], s.Point.V)
+		}
+		for k := range m {
+			sort.Float64s(m[k])
+		}
+		return m
+	}
+	ga, gb := group(a), group(b)
+	if len(ga) != len(gb) {
+		return false
+	}
+	for pod, av := range ga {
+		bv, ok := gb[pod]
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if av[i] != bv[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func sameValues(a, b []promql.Sample) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	av := make([]float64, len(a))
+	bv := make([]float64, len(b))
+	for i := range a {
+		av[i] = a[i].Point.V
+		bv[i] = b[i].Point.V
+	}
+	sort.Float64s(av)
+	sort.Float64s(bv)
+	for i := range av {
+		if av[i] != bv[i] {
+			return false
+		}
+	}
+	return true
+}
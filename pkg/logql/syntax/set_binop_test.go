@@ -0,0 +1,86 @@
+package syntax
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// TestMergeSetBinOp covers and/or/unless set matching, with cases derived
+// from Prometheus' operators.test vector-matching fixtures (two "method"
+// label series on each side, partially overlapping).
+func TestMergeSetBinOp(t *testing.T) {
+	lhs := []promql.Sample{
+		{Metric: labels.FromStrings("method", "get"), Point: promql.Point{V: 1}},
+		{Metric: labels.FromStrings("method", "post"), Point: promql.Point{V: 2}},
+	}
+	rhs := []promql.Sample{
+		{Metric: labels.FromStrings("method", "post"), Point: promql.Point{V: 10}},
+		{Metric: labels.FromStrings("method", "put"), Point: promql.Point{V: 20}},
+	}
+
+	for _, tc := range []struct {
+		name string
+		op   string
+		vm   *VectorMatching
+		want []string
+	}{
+		{"and", OpTypeAnd, nil, []string{"post"}},
+		{"or", OpTypeOr, nil, []string{"get", "post", "put"}},
+		{"unless", OpTypeUnless, nil, []string{"get"}},
+		{"and_on_method", OpTypeAnd, &VectorMatching{On: true, MatchingLabels: []string{"method"}}, []string{"post"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := MergeSetBinOp(tc.op, lhs, rhs, tc.vm)
+			var methods []string
+			for _, s := range got {
+				methods = append(methods, s.Metric.Get("method"))
+			}
+			sort.Strings(methods)
+			if len(methods) != len(tc.want) {
+				t.Fatalf("got %v, want %v", methods, tc.want)
+			}
+			for i := range methods {
+				if methods[i] != tc.want[i] {
+					t.Fatalf("got %v, want %v", methods, tc.want)
+				}
+			}
+		})
+	}
+}
+
+// TestBinOpExpr_Shardable_VectorMatchingDisablesLogicalOps guards against
+// the and/or shard fast-path bypassing the on()/ignoring() safety net: a
+// shard only ever sees a subset of series, so it can't be trusted to
+// decide set membership under an explicit matching clause on its own.
+func TestBinOpExpr_Shardable_VectorMatchingDisablesLogicalOps(t *testing.T) {
+	shardableLeft := &LiteralExpr{Val: 1}
+	shardableRight := &LiteralExpr{Val: 2}
+
+	for _, op := range []string{OpTypeAnd, OpTypeOr} {
+		b := &BinOpExpr{
+			SampleExpr: shardableLeft,
+			RHS:        shardableRight,
+			Op:         op,
+			Opts: &BinOpOptions{
+				VectorMatching: &VectorMatching{On: true, MatchingLabels: []string{"method"}},
+			},
+		}
+		if b.Shardable() {
+			t.Fatalf("%s with an explicit on() clause must not be reported shardable", op)
+		}
+	}
+
+	for _, op := range []string{OpTypeAnd, OpTypeOr} {
+		b := &BinOpExpr{
+			SampleExpr: shardableLeft,
+			RHS:        shardableRight,
+			Op:         op,
+		}
+		if !b.Shardable() {
+			t.Fatalf("%s without a matching clause should still be shardable", op)
+		}
+	}
+}
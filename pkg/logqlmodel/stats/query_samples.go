@@ -0,0 +1,54 @@
+package stats
+
+// QuerySamples accumulates, per evaluation step, how many log/sample lines
+// a query's sub-expressions consumed. syntax.CountQuerySamples is the
+// current caller: it walks a SampleExpr's leaves (via the Children method
+// on BinOpExpr/LabelReplaceExpr/LabelJoinExpr/HistogramVectorExpr) and
+// calls Add once per distinct leaf per
+// step, so a leaf shared by more than one leg isn't double-counted. The
+// step evaluator constructors are a planned follow-up caller once they're
+// threaded through to accept a sink and a real per-leaf sample count.
+type QuerySamples struct {
+	enablePerStep bool
+	total         int64
+	perStep       []int64
+}
+
+// NewQuerySamples returns a sink that always tracks Total, and additionally
+// records a per-step breakdown when enablePerStep is true (EnablePerStepStats).
+func NewQuerySamples(enablePerStep bool, steps int) *QuerySamples {
+	qs := &QuerySamples{enablePerStep: enablePerStep}
+	if enablePerStep {
+		qs.perStep = make([]int64, steps)
+	}
+	return qs
+}
+
+// Add records n additional samples consumed at step index idx. It is safe
+// to call on a nil *QuerySamples, in which case it's a no-op.
+func (q *QuerySamples) Add(idx int, n int64) {
+	if q == nil || n == 0 {
+		return
+	}
+	q.total += n
+	if q.enablePerStep && idx >= 0 && idx < len(q.perStep) {
+		q.perStep[idx] += n
+	}
+}
+
+// Total returns the running total of samples consumed across all steps.
+func (q *QuerySamples) Total() int64 {
+	if q == nil {
+		return 0
+	}
+	return q.total
+}
+
+// PerStep returns the per-step sample counts, or nil if per-step stats
+// weren't enabled for this sink.
+func (q *QuerySamples) PerStep() []int64 {
+	if q == nil {
+		return nil
+	}
+	return q.perStep
+}